@@ -0,0 +1,115 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// sqlResult is the outcome of running a statement against a cockroach binary:
+// either a set of result rows, or the pgcode of an error it produced.
+type sqlResult struct {
+	rows   []string
+	pgcode string
+}
+
+var pgcodeRE = regexp.MustCompile(`pgcode: (\S+)`)
+
+// runSQL executes sql against the cockroach binary at path (using `demo`, the
+// same entry point the rest of the reducer uses) and classifies the output as
+// either a row set or an error pgcode.
+func runSQL(ctx context.Context, path, sql string) (sqlResult, error) {
+	if !strings.HasSuffix(sql, ";") {
+		sql += ";"
+	}
+	cmd := exec.CommandContext(ctx, path, "demo", "--format=csv")
+	cmd.Stdin = strings.NewReader(sql)
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return sqlResult{}, err
+	}
+	if m := pgcodeRE.FindStringSubmatch(string(out)); m != nil {
+		return sqlResult{pgcode: m[1]}, nil
+	}
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	return sqlResult{rows: lines}, nil
+}
+
+// differs reports whether a and b represent different outcomes. Row sets are
+// compared in order unless unordered is set, in which case they are compared
+// as multisets so that differences in output order alone aren't considered
+// interesting.
+func (a sqlResult) differs(b sqlResult, unordered bool) bool {
+	if a.pgcode != b.pgcode {
+		return true
+	}
+	if a.pgcode != "" {
+		// Both sides errored with the same pgcode; don't also compare rows,
+		// since there aren't any.
+		return false
+	}
+	if !unordered {
+		return !equalStrings(a.rows, b.rows)
+	}
+	return !equalSortedStrings(a.rows, b.rows)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalSortedStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string(nil), a...)
+	sortedB := append([]string(nil), b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	return equalStrings(sortedA, sortedB)
+}
+
+// costRowsRE strips the cost/row-count estimates that EXPLAIN (OPT, VERBOSE)
+// annotates every node with (e.g. "cost=123.45 rows=10"), so that plan diffs
+// reduce on shape rather than on estimates that can legitimately differ
+// between binaries built from different commits.
+var costRowsRE = regexp.MustCompile(`\s*cost=[0-9.]+(?:e[+-]?[0-9]+)?\s*rows=[0-9.]+(?:e[+-]?[0-9]+)?`)
+
+// explainPlan wraps sql so that running it returns its optimizer plan instead
+// of its result rows.
+func explainPlan(sql string) string {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	return fmt.Sprintf("EXPLAIN (OPT, VERBOSE) %s;", sql)
+}
+
+// normalizePlan removes cost/row-count estimates from an EXPLAIN (OPT,
+// VERBOSE) plan so that two plans of the same shape compare equal even if
+// the underlying estimates differ.
+func normalizePlan(rows []string) []string {
+	out := make([]string, len(rows))
+	for i, row := range rows {
+		out[i] = costRowsRE.ReplaceAllString(row, "")
+	}
+	return out
+}
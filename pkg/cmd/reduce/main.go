@@ -14,6 +14,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -35,6 +36,14 @@ var (
 	verbose  = flags.Bool("v", false, "log progress")
 	contains = flags.String("contains", "", "error regex to search for")
 	unknown  = flags.Bool("unknown", false, "print unknown types during walk")
+	parallel = flags.Int("j", 1, "number of interestingness checks to run concurrently per pass")
+	seed     = flags.Int64("seed", 0, "seed for the random source used by reduction passes, for reproducible reductions")
+
+	diff = flags.String("diff", "", "path to a second cockroach binary; if set, the input is interesting when it "+
+		"produces different results (rows, error pgcodes, or plans with -plan-diff) between path and diff, "+
+		"instead of (or in addition to) matching -contains")
+	planDiff  = flags.Bool("plan-diff", false, "with -diff, compare EXPLAIN (OPT, VERBOSE) plans instead of query results")
+	unordered = flags.Bool("unordered-rows", false, "with -diff, compare result rows as a set rather than in order")
 )
 
 func usage() {
@@ -47,22 +56,32 @@ func main() {
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		usage()
 	}
-	if *contains == "" {
-		fmt.Print("missing contains\n\n")
+	if *contains == "" && *diff == "" {
+		fmt.Print("missing contains or diff\n\n")
 		usage()
 	}
 	reducesql.LogUnknown = *unknown
-	out, err := reduceSQL(*path, *contains, *verbose)
+	out, err := reduceSQL(*path, *contains, *diff, *verbose, *parallel, *seed, *planDiff, *unordered)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println(out)
 }
 
-func reduceSQL(path, contains string, verbose bool) (string, error) {
-	containsRE, err := regexp.Compile(contains)
-	if err != nil {
-		return "", err
+func reduceSQL(
+	path, contains, diffPath string,
+	verbose bool,
+	parallel int,
+	seed int64,
+	planDiff, unordered bool,
+) (string, error) {
+	var containsRE *regexp.Regexp
+	var err error
+	if contains != "" {
+		containsRE, err = regexp.Compile(contains)
+		if err != nil {
+			return "", err
+		}
 	}
 	var input []byte
 	{
@@ -93,8 +112,8 @@ func reduceSQL(path, contains string, verbose bool) (string, error) {
 		fmt.Fprintf(logger, "input SQL pretty printed, %d bytes -> %d bytes\n", len(input), len(inputSQL))
 	}
 
-	interesting := func(f reduce.File) bool {
-		cmd := exec.Command(path, "demo")
+	matchesContains := func(ctx context.Context, f reduce.File) bool {
+		cmd := exec.CommandContext(ctx, path, "demo")
 		sql := string(f)
 		if !strings.HasSuffix(sql, ";") {
 			sql += ";"
@@ -109,9 +128,56 @@ func reduceSQL(path, contains string, verbose bool) (string, error) {
 		case *os.PathError:
 			log.Fatal(err)
 		}
+		if ctx.Err() != nil {
+			// A sibling candidate in this batch already won the race; cmd
+			// was killed by CommandContext, so its output is meaningless.
+			return false
+		}
 		return containsRE.Match(out)
 	}
 
-	out, err := reduce.Reduce(logger, reduce.File(inputSQL), interesting, reducesql.SQLPasses...)
+	matchesDiff := func(ctx context.Context, f reduce.File) bool {
+		sql := string(f)
+		if planDiff {
+			sql = explainPlan(sql)
+		}
+		r1, err := runSQL(ctx, path, sql)
+		if err != nil {
+			if ctx.Err() != nil {
+				// A sibling candidate in this batch already won the race;
+				// cmd was killed mid-run, so this error is expected and the
+				// candidate is simply not interesting.
+				return false
+			}
+			log.Fatal(err)
+		}
+		r2, err := runSQL(ctx, diffPath, sql)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			log.Fatal(err)
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if planDiff {
+			r1.rows, r2.rows = normalizePlan(r1.rows), normalizePlan(r2.rows)
+		}
+		return r1.differs(r2, unordered)
+	}
+
+	interesting := func(ctx context.Context, f reduce.File) bool {
+		if containsRE != nil && matchesContains(ctx, f) {
+			return true
+		}
+		if diffPath != "" && matchesDiff(ctx, f) {
+			return true
+		}
+		return false
+	}
+
+	opts := []reduce.Option{reduce.OptionParallel(parallel), reduce.OptionSeed(seed)}
+	out, err := reduce.Reduce(logger, reduce.File(inputSQL), interesting, opts, reducesql.SQLPasses...)
 	return string(out), err
 }
@@ -0,0 +1,247 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package norm
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// cseMinOperatorCount is the minimum number of scalar operators a repeated
+// subexpression must have before it's considered worth factoring out into a
+// shared column. Below this threshold, the extra Project and Variable
+// indirection costs more than just recomputing the (trivial) expression at
+// each use, e.g. there's no point sharing a lone column reference.
+const cseMinOperatorCount = 2
+
+// HasDuplicateSubexpressionsInProjections returns true if any non-trivial,
+// non-volatile scalar subexpression appears two or more times among the
+// items of the given Projections operator. It's a cheap, conservative
+// pre-check used by the EliminateCSEInProjections rule so that the more
+// expensive ConstructCSEProject rewrite is only attempted when it has a
+// chance of firing; false positives here just cost a wasted rewrite attempt,
+// never correctness.
+func (c *CustomFuncs) HasDuplicateSubexpressionsInProjections(projections memo.GroupID) bool {
+	ev := memo.MakeNormExprView(&c.f.mem, projections)
+	items := c.f.mem.LookupList(ev.ChildGroup(0).(memo.ListID))
+
+	counts := make(map[memo.Fingerprint]int)
+	found := false
+	for _, item := range items {
+		c.forEachCSECandidate(item, func(fingerprint memo.Fingerprint) {
+			counts[fingerprint]++
+			if counts[fingerprint] == 2 {
+				found = true
+			}
+		})
+	}
+	return found
+}
+
+// forEachCSECandidate calls fn with the fingerprint of every scalar subtree
+// of group (including group itself) that is eligible for common
+// subexpression elimination: it must be non-volatile (see CustomFuncs.
+// IsVolatile, which already skips Random, Now, and similar functions so that
+// sharing a single evaluation doesn't change query semantics), and it must
+// have at least cseMinOperatorCount operators. It returns group's own
+// operator count so a caller one level up can fold it into its own count,
+// rather than stashing it in group's memoized Logical properties - those are
+// shared and cached across unrelated callers, so writing a CSE-specific
+// derived value into them risks a stale or clobbered count the next time
+// something else reads Scalar.OpCount.
+func (c *CustomFuncs) forEachCSECandidate(group memo.GroupID, fn func(memo.Fingerprint)) int {
+	if c.f.funcs.IsVolatile(group) {
+		return 1
+	}
+	ev := memo.MakeNormExprView(&c.f.mem, group)
+	opCount := 1
+	for i, n := 0, ev.ChildCount(); i < n; i++ {
+		child := ev.Child(i)
+		if !child.IsScalar() {
+			continue
+		}
+		opCount += c.forEachCSECandidate(child.Group(), fn)
+	}
+	if opCount >= cseMinOperatorCount {
+		fn(ev.Fingerprint())
+	}
+	return opCount
+}
+
+// ConstructCSEProject rewrites the projections of a Project operator so that
+// any scalar subexpression appearing two or more times is computed in a
+// wrapping Project placed below the existing one, and its second and later
+// occurrences reference that column via a Variable. The first occurrence is
+// left in place, so the subexpression is still evaluated there as well as in
+// the wrapping Project. See the EliminateCSEInProjections rule in cse.opt.
+//
+// Because cse.opt's match clause (rather than optgen-generated dispatch code)
+// is what decides this rule applies, ConstructCSEProject is also where the
+// matched/applied notifications for EliminateCSEInProjections fire - this is
+// the only point that knows both the pre-rewrite projections group and,
+// once rewriting finishes, the columns it hoisted.
+func (f *Factory) ConstructCSEProject(input, projections memo.GroupID) memo.GroupID {
+	ev := memo.MakeNormExprView(&f.mem, projections)
+	preFingerprint := ev.Fingerprint()
+
+	if f.matchedRule != nil && !f.matchedRule(opt.EliminateCSEInProjections, projections) {
+		// f.ConstructProject is the public, rule-checking entry point that
+		// dispatches back to this same function as long as
+		// HasDuplicateSubexpressionsInProjections still matches - which it
+		// always will here, since nothing has changed. Build the Project
+		// directly via the memo instead, so a vetoed rule (e.g. via
+		// DisableOptimizations) skips cleanly rather than recursing forever.
+		return f.DynamicConstruct(opt.ProjectOp, []memo.GroupID{input, projections}, nil)
+	}
+
+	cse := &cseRewriter{f: f, colsByFingerprint: make(map[memo.Fingerprint]opt.ColumnID)}
+
+	def := ev.Private().(*memo.ProjectionsOpDef)
+	items := f.mem.LookupList(ev.ChildGroup(0).(memo.ListID))
+
+	newItems := make([]memo.GroupID, len(items))
+	for i, item := range items {
+		newItems[i], _ = cse.rewrite(item)
+	}
+
+	if len(cse.hoisted) == 0 {
+		// Nothing was actually duplicated once volatility and the cost
+		// threshold were taken into account. As above, build the Project
+		// directly rather than through f.ConstructProject, which would just
+		// match and recurse into this function again.
+		return f.DynamicConstruct(opt.ProjectOp, []memo.GroupID{input, projections}, nil)
+	}
+
+	pb := projectionsBuilder{f: f}
+	pb.addPassthroughCols(f.funcs.OutputCols(input))
+	for _, h := range cse.hoisted {
+		pb.addSynthesized(h.expr, h.col)
+	}
+	wrappedInput := f.ConstructProject(input, pb.buildProjections())
+
+	newDef := *def
+	newProjections := f.ConstructProjections(
+		f.InternList(newItems), f.InternProjectionsOpDef(&newDef),
+	)
+	result := f.ConstructProject(wrappedInput, newProjections)
+
+	if f.appliedRule != nil {
+		f.appliedRule(opt.EliminateCSEInProjections, result, 0, len(cse.hoisted))
+	}
+	if f.appliedRuleV2 != nil {
+		var bindings RuleBindings
+		bindings.Add("input", input)
+		bindings.Add("projections", projections)
+		f.appliedRuleV2(
+			opt.EliminateCSEInProjections, result, 0, len(cse.hoisted), &bindings, preFingerprint,
+		)
+	}
+	return result
+}
+
+// hoistedScalarCol records a scalar subexpression that cseRewriter decided to
+// compute once, in the outer Project, rather than once per use.
+type hoistedScalarCol struct {
+	expr memo.GroupID
+	col  opt.ColumnID
+}
+
+// cseRewriter replaces duplicated scalar subtrees with Variable references
+// to a shared column, synthesizing that column (and recording it in hoisted)
+// the second time a given fingerprint is seen.
+type cseRewriter struct {
+	f                 *Factory
+	colsByFingerprint map[memo.Fingerprint]opt.ColumnID
+	hoisted           []hoistedScalarCol
+
+	// seen tracks fingerprints that have been visited once already, so that
+	// the second occurrence of a non-trivial subtree triggers hoisting.
+	seen map[memo.Fingerprint]bool
+}
+
+// rewrite returns the (possibly rewritten) replacement for group, along with
+// group's own operator count (computed the same way forEachCSECandidate
+// computed it during the earlier match pass, rather than read back out of
+// group's memoized Logical properties - see forEachCSECandidate). If group
+// is a duplicate of a subtree seen earlier, it's replaced by a Variable
+// referencing the shared column; otherwise it's rewritten in place (its
+// children may still be replaced) and, the second time its fingerprint is
+// seen, hoisted into its own column for subsequent occurrences to share.
+func (r *cseRewriter) rewrite(group memo.GroupID) (memo.GroupID, int) {
+	if r.f.funcs.IsVolatile(group) {
+		return group, 1
+	}
+	ev := memo.MakeNormExprView(&r.f.mem, group)
+	fp := ev.Fingerprint()
+
+	if col, ok := r.colsByFingerprint[fp]; ok {
+		return r.f.ConstructVariable(r.f.funcs.InternColumnID(col)), 1
+	}
+
+	rewroteChild := false
+	opCount := 1
+	children := make([]memo.GroupID, ev.ChildCount())
+	for i, n := 0, ev.ChildCount(); i < n; i++ {
+		child := ev.Child(i)
+		children[i] = child.Group()
+		if !child.IsScalar() {
+			continue
+		}
+		newChild, childOpCount := r.rewrite(child.Group())
+		opCount += childOpCount
+		if newChild != child.Group() {
+			children[i] = newChild
+			rewroteChild = true
+		}
+	}
+	if rewroteChild {
+		// A nested duplicate was found and replaced below us; rebuild this
+		// expression from the rewritten children so the substitution is
+		// actually visible to our caller, rather than just being recorded in
+		// colsByFingerprint/hoisted for bookkeeping purposes.
+		group = r.f.DynamicConstruct(ev.Operator(), children, ev.Private())
+		ev = memo.MakeNormExprView(&r.f.mem, group)
+		fp = ev.Fingerprint()
+		if col, ok := r.colsByFingerprint[fp]; ok {
+			return r.f.ConstructVariable(r.f.funcs.InternColumnID(col)), opCount
+		}
+	}
+
+	if opCount >= cseMinOperatorCount {
+		if r.countIfSeenAgain(fp) {
+			col := r.f.Metadata().AddColumn("cse", ev.Logical().Scalar.Type)
+			r.colsByFingerprint[fp] = col
+			r.hoisted = append(r.hoisted, hoistedScalarCol{expr: group, col: col})
+			return r.f.ConstructVariable(r.f.funcs.InternColumnID(col)), 1
+		}
+	}
+	return group, opCount
+}
+
+// countIfSeenAgain returns false the first time it's called with a given
+// fingerprint and true on every later call. In practice rewrite calls it at
+// most twice per fingerprint: after the second call the fingerprint has been
+// hoisted into colsByFingerprint, and rewrite never reaches this code path
+// for it again.
+func (r *cseRewriter) countIfSeenAgain(fp memo.Fingerprint) bool {
+	if r.seen == nil {
+		r.seen = make(map[memo.Fingerprint]bool)
+	}
+	if r.seen[fp] {
+		return true
+	}
+	r.seen[fp] = true
+	return false
+}
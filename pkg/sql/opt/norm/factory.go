@@ -25,9 +25,10 @@ import (
 // MatchedRuleFunc defines the callback function for the NotifyOnMatchedRule
 // event supported by the optimizer and factory. It is invoked each time an
 // optimization rule (Normalize or Explore) has been matched. The name of the
-// matched rule is passed as a parameter. If the function returns false, then
-// the rule is not applied (i.e. skipped).
-type MatchedRuleFunc func(ruleName opt.RuleName) bool
+// matched rule and the group its pattern matched against are passed as
+// parameters. If the function returns false, then the rule is not applied
+// (i.e. skipped).
+type MatchedRuleFunc func(ruleName opt.RuleName, group memo.GroupID) bool
 
 // AppliedRuleFunc defines the callback function for the NotifyOnAppliedRule
 // event supported by the optimizer and factory. It is invoked each time an
@@ -41,6 +42,27 @@ type AppliedRuleFunc func(
 	ruleName opt.RuleName, group memo.GroupID, expr memo.ExprOrdinal, added int,
 )
 
+// AppliedRuleFuncV2 is a richer sibling of AppliedRuleFunc: in addition to
+// the rule name, group, expression ordinal, and added count, it receives the
+// bindings the rule site recorded for the rule's named sub-patterns, and the
+// fingerprint of the expression as it was just before the rule replaced it.
+// Together these are enough to reconstruct exactly why a rule fired, without
+// resorting to diffing optsteps output by eye.
+//
+// Register it with NotifyOnAppliedRuleV2 rather than NotifyOnAppliedRule.
+// The two callbacks can be registered at the same time. AppliedRuleFunc is
+// invoked for every applied rule; AppliedRuleFuncV2 is invoked only by the
+// hand-written CSE and LICM rule sites (cse.go, licm.go), not by
+// optgen-generated rule sites.
+type AppliedRuleFuncV2 func(
+	ruleName opt.RuleName,
+	group memo.GroupID,
+	expr memo.ExprOrdinal,
+	added int,
+	bindings *RuleBindings,
+	preFingerprint memo.Fingerprint,
+)
+
 // Factory constructs a normalized expression tree within the memo. As each
 // kind of expression is constructed by the factory, it transitively runs
 // normalization transformations defined for that expression type. This may
@@ -82,6 +104,17 @@ type Factory struct {
 	// NotifyOnAppliedRule method.
 	appliedRule AppliedRuleFunc
 
+	// appliedRuleV2 is the richer sibling of appliedRule, set via
+	// NotifyOnAppliedRuleV2. Each rule site that wants to populate it checks
+	// this field directly (rather than going through a method call), so that
+	// when no V2 listener is registered, the bindings and fingerprint needed
+	// only by appliedRuleV2 are never constructed: the
+	// `if f.appliedRuleV2 != nil { ... }` check compiles the entire
+	// binding-construction block out of the hot path. Only the CSE and LICM
+	// rule sites (cse.go, licm.go) do this checking and populating;
+	// optgen-generated rule sites never invoke appliedRuleV2.
+	appliedRuleV2 AppliedRuleFuncV2
+
 	// ruleCycles is used to detect cyclical rule invocations. Each rule with
 	// the "DetectCycles" tag adds its expression fingerprint into this map
 	// before constructing its replacement. If the replacement pattern recursively
@@ -90,6 +123,13 @@ type Factory struct {
 	// map, and will skip application of the rule.
 	ruleCycles ruleCycles
 
+	// cycleSkipped, if non-nil, is invoked whenever ruleCycles vetoes a rule
+	// application because of a detected cycle. It's set by StartRecording so
+	// that a RuleTrace faithfully records cycle skips alongside applied
+	// rules; without it, a replay could be fooled into thinking a rule
+	// applied when it was really skipped to avoid infinite recursion.
+	cycleSkipped func(ruleName opt.RuleName, fingerprint memo.Fingerprint)
+
 	// scratchItems is a slice that is reused by projectionsBuilder to store
 	// temporary results that are accumulated before constructing a new
 	// Projections operator.
@@ -109,14 +149,29 @@ func (f *Factory) Init(evalCtx *tree.EvalContext) {
 	f.funcs.Init(f)
 	f.matchedRule = nil
 	f.appliedRule = nil
+	f.appliedRuleV2 = nil
+	f.cycleSkipped = nil
 	f.ruleCycles.init()
 }
 
+// detectCycle is a thin wrapper around ruleCycles.detectCycle that also
+// notifies cycleSkipped, if one is registered, so that a RuleTrace recording
+// sees cycle skips as well as applied rules.
+func (f *Factory) detectCycle(ruleName opt.RuleName, fp memo.Fingerprint) bool {
+	if !f.ruleCycles.detectCycle(fp) {
+		return false
+	}
+	if f.cycleSkipped != nil {
+		f.cycleSkipped(ruleName, fp)
+	}
+	return true
+}
+
 // DisableOptimizations disables all transformation rules. The unaltered input
 // expression tree becomes the output expression tree (because no transforms
 // are applied).
 func (f *Factory) DisableOptimizations() {
-	f.NotifyOnMatchedRule(func(opt.RuleName) bool { return false })
+	f.NotifyOnMatchedRule(func(opt.RuleName, memo.GroupID) bool { return false })
 }
 
 // NotifyOnMatchedRule sets a callback function which is invoked each time a
@@ -135,6 +190,16 @@ func (f *Factory) NotifyOnAppliedRule(appliedRule AppliedRuleFunc) {
 	f.appliedRule = appliedRule
 }
 
+// NotifyOnAppliedRuleV2 sets a callback function which is invoked each time
+// the CSE or LICM rules (cse.go, licm.go) are applied by the factory, with
+// the bindings those rule sites record for the rule's named sub-patterns.
+// Optgen-generated rules do not invoke it. If appliedRuleV2 is nil, then no
+// further notifications are sent, and those rule sites skip constructing
+// bindings entirely.
+func (f *Factory) NotifyOnAppliedRuleV2(appliedRuleV2 AppliedRuleFuncV2) {
+	f.appliedRuleV2 = appliedRuleV2
+}
+
 // Memo returns the memo structure that the factory is operating upon.
 func (f *Factory) Memo() *memo.Memo {
 	return &f.mem
@@ -168,6 +233,18 @@ func (f *Factory) AssignPlaceholders() {
 	f.Memo().SetRoot(root, f.Memo().RootProps())
 }
 
+// DynamicConstruct reconstructs an expression with operator op, given
+// children and private, by dispatching to the appropriate generated
+// ConstructXxx method. It's the same generic construction entry point
+// AssignPlaceholders uses to rebuild an ancestor after one of its descendants
+// changes; custom normalization passes that rewrite a scalar subtree in place
+// (rather than matching a single fixed shape) use it for the same reason -
+// to rebuild a node from its (possibly just-rewritten) children without a
+// giant switch over every operator.
+func (f *Factory) DynamicConstruct(op opt.Operator, children []memo.GroupID, private interface{}) memo.GroupID {
+	return f.mem.DynamicConstruct(f, op, children, private)
+}
+
 // onConstruct is called as a final step by each factory construction method,
 // so that any custom manual pattern matching/replacement code can be run.
 func (f *Factory) onConstruct(e memo.Expr) memo.GroupID {
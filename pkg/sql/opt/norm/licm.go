@@ -0,0 +1,260 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package norm
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// HasHoistableInvariant returns true if the on-filters of a correlated Apply
+// join contain a scalar subexpression that's invariant with respect to the
+// inner (right) side: its free columns (via the memo's logical OuterCols
+// property) are all produced by left, and none are produced by the inner
+// relation the Apply join is being applied once per left row to. Hoisting
+// such a subexpression turns a per-(outer row, inner row) evaluation into a
+// single per-outer-row evaluation.
+func (c *CustomFuncs) HasHoistableInvariant(left, on memo.GroupID) bool {
+	leftCols := c.f.funcs.OutputCols(left)
+	found := false
+	c.forEachConjunct(on, func(conjunct memo.GroupID) {
+		if found {
+			return
+		}
+		c.forEachLICMCandidate(conjunct, leftCols, func(memo.GroupID) {
+			found = true
+		})
+	})
+	return found
+}
+
+// forEachConjunct calls fn once for each top-level conjunct of a Filters
+// operator group.
+func (c *CustomFuncs) forEachConjunct(filters memo.GroupID, fn func(conjunct memo.GroupID)) {
+	ev := memo.MakeNormExprView(&c.f.mem, filters)
+	items := c.f.mem.LookupList(ev.ChildGroup(0).(memo.ListID))
+	for _, item := range items {
+		fn(item)
+	}
+}
+
+// forEachLICMCandidate walks the scalar subtree rooted at group, calling fn
+// with every subtree that is:
+//   - non-volatile (skipping Random, Now, and similar, via CustomFuncs.
+//     IsVolatile, so hoisting can't change how many times a side-effecting
+//     function is evaluated),
+//   - not a bare Variable (hoisting a single column reference saves nothing),
+//   - and has OuterCols (the columns it references) entirely contained in
+//     leftCols, with no references to any column produced by the inner side.
+//
+// It does not recurse into a subtree once that subtree itself qualifies,
+// since hoisting the outer subtree already hoists everything beneath it.
+func (c *CustomFuncs) forEachLICMCandidate(
+	group memo.GroupID, leftCols opt.ColSet, fn func(memo.GroupID),
+) {
+	if c.f.funcs.IsVolatile(group) {
+		return
+	}
+	ev := memo.MakeNormExprView(&c.f.mem, group)
+	if ev.Operator() == opt.VariableOp {
+		return
+	}
+	refs := ev.Logical().Scalar.OuterCols
+	if refs.Len() > 0 && refs.SubsetOf(leftCols) {
+		fn(group)
+		return
+	}
+	for i, n := 0, ev.ChildCount(); i < n; i++ {
+		child := ev.Child(i)
+		if child.IsScalar() {
+			c.forEachLICMCandidate(child.Group(), leftCols, fn)
+		}
+	}
+}
+
+// licmHoist rewrites the on-filters of a correlated Apply join, replacing
+// every hoistable invariant subexpression (see HasHoistableInvariant) with a
+// Variable referencing a new column, and returns the new left side (wrapped
+// in a Project that synthesizes those columns) along with the rewritten
+// on-filters. If nothing was hoisted, it returns the original left and on
+// groups unchanged.
+//
+// Because licm.opt's match clause (rather than optgen-generated dispatch
+// code) is what decides one of the HoistInvariantXxxJoinApply rules applies,
+// licmHoist is also where the matched/applied notifications for ruleName
+// fire - this is the only point that knows both the pre-rewrite on group and,
+// once rewriting finishes, the columns it hoisted.
+//
+// All four HoistInvariantXxxJoinApply rules are tagged DetectCycles in
+// licm.opt, since LICM and the decorrelation rules can otherwise push and
+// pull the same Apply join back and forth forever; licmHoist pushes the
+// pre-rewrite fingerprint onto f.ruleCycles for the duration of the rewrite
+// so a recursive invocation with that same fingerprint is detected and
+// skipped rather than looping.
+func (f *Factory) licmHoist(
+	ruleName opt.RuleName, left, right, on memo.GroupID,
+) (newLeft, newOn memo.GroupID) {
+	ev := memo.MakeNormExprView(&f.mem, on)
+	preFingerprint := ev.Fingerprint()
+
+	if f.matchedRule != nil && !f.matchedRule(ruleName, on) {
+		return left, on
+	}
+	if f.detectCycle(ruleName, preFingerprint) {
+		return left, on
+	}
+	f.ruleCycles.push(preFingerprint)
+	defer f.ruleCycles.pop()
+
+	leftCols := f.funcs.OutputCols(left)
+	var hoisted []hoistedScalarCol
+
+	items := f.mem.LookupList(ev.ChildGroup(0).(memo.ListID))
+	newItems := make([]memo.GroupID, len(items))
+	for i, item := range items {
+		newItems[i] = f.licmRewrite(item, leftCols, &hoisted)
+	}
+
+	if len(hoisted) == 0 {
+		return left, on
+	}
+
+	pb := projectionsBuilder{f: f}
+	pb.addPassthroughCols(leftCols)
+	for _, h := range hoisted {
+		pb.addSynthesized(h.expr, h.col)
+	}
+	newLeft = f.ConstructProject(left, pb.buildProjections())
+
+	def := ev.Private().(*memo.FiltersOpDef)
+	newDef := *def
+	newOn = f.ConstructFilters(f.InternList(newItems), f.InternFiltersOpDef(&newDef))
+
+	if f.appliedRule != nil {
+		f.appliedRule(ruleName, newOn, 0, len(hoisted))
+	}
+	if f.appliedRuleV2 != nil {
+		var bindings RuleBindings
+		bindings.Add("left", left)
+		bindings.Add("right", right)
+		bindings.Add("on", on)
+		f.appliedRuleV2(ruleName, newOn, 0, len(hoisted), &bindings, preFingerprint)
+	}
+	return newLeft, newOn
+}
+
+// licmRewrite returns the replacement for group: if group itself qualifies
+// as a hoistable invariant (per forEachLICMCandidate's criteria), it
+// allocates a new column for it, appends it to *hoisted, and returns a
+// Variable referencing that column; otherwise it recurses into group's
+// scalar children, rebuilding group from their (possibly rewritten)
+// replacements so that a candidate nested arbitrarily deep - such as the
+// f(outer.x) in a top-level "f(outer.x) = inner.y" conjunct, which itself
+// mixes outer and inner columns and so doesn't qualify - is still found and
+// hoisted.
+func (f *Factory) licmRewrite(
+	group memo.GroupID, leftCols opt.ColSet, hoisted *[]hoistedScalarCol,
+) memo.GroupID {
+	if f.funcs.IsVolatile(group) {
+		return group
+	}
+	ev := memo.MakeNormExprView(&f.mem, group)
+	if ev.Operator() != opt.VariableOp {
+		refs := ev.Logical().Scalar.OuterCols
+		if refs.Len() > 0 && refs.SubsetOf(leftCols) {
+			col := f.Metadata().AddColumn("licm", ev.Logical().Scalar.Type)
+			*hoisted = append(*hoisted, hoistedScalarCol{expr: group, col: col})
+			return f.ConstructVariable(f.funcs.InternColumnID(col))
+		}
+	}
+
+	// group itself doesn't qualify (it references both outer and inner
+	// columns, or is already just a Variable), but a subtree further down
+	// may still be purely outer-scope. Recurse into the scalar children and,
+	// if any of them were replaced, rebuild group from the new children so
+	// the replacement is actually reflected in what we return, rather than
+	// only being recorded in *hoisted.
+	rewroteChild := false
+	children := make([]memo.GroupID, ev.ChildCount())
+	for i, n := 0, ev.ChildCount(); i < n; i++ {
+		child := ev.Child(i)
+		children[i] = child.Group()
+		if !child.IsScalar() {
+			continue
+		}
+		if newChild := f.licmRewrite(child.Group(), leftCols, hoisted); newChild != child.Group() {
+			children[i] = newChild
+			rewroteChild = true
+		}
+	}
+	if !rewroteChild {
+		return group
+	}
+	return f.DynamicConstruct(ev.Operator(), children, ev.Private())
+}
+
+// ConstructLICMInnerJoinApply implements the HoistInvariantInnerJoinApply
+// rule: see licm.opt.
+func (f *Factory) ConstructLICMInnerJoinApply(
+	left, right, on, private memo.GroupID,
+) memo.GroupID {
+	newLeft, newOn := f.licmHoist(opt.HoistInvariantInnerJoinApply, left, right, on)
+	if newLeft == left && newOn == on {
+		// Nothing was hoisted (the rule was vetoed, or there was no
+		// invariant to hoist); f.ConstructInnerJoinApply is the public,
+		// rule-checking entry point that would just dispatch back into this
+		// same function, since HasHoistableInvariant still matches. Build
+		// the join directly via the memo instead, so that's a clean skip
+		// rather than infinite recursion.
+		return f.DynamicConstruct(opt.InnerJoinApplyOp, []memo.GroupID{newLeft, right, newOn}, private)
+	}
+	return f.ConstructInnerJoinApply(newLeft, right, newOn, private)
+}
+
+// ConstructLICMLeftJoinApply implements the HoistInvariantLeftJoinApply
+// rule: see licm.opt.
+func (f *Factory) ConstructLICMLeftJoinApply(
+	left, right, on, private memo.GroupID,
+) memo.GroupID {
+	newLeft, newOn := f.licmHoist(opt.HoistInvariantLeftJoinApply, left, right, on)
+	if newLeft == left && newOn == on {
+		return f.DynamicConstruct(opt.LeftJoinApplyOp, []memo.GroupID{newLeft, right, newOn}, private)
+	}
+	return f.ConstructLeftJoinApply(newLeft, right, newOn, private)
+}
+
+// ConstructLICMSemiJoinApply implements the HoistInvariantSemiJoinApply
+// rule: see licm.opt.
+func (f *Factory) ConstructLICMSemiJoinApply(
+	left, right, on, private memo.GroupID,
+) memo.GroupID {
+	newLeft, newOn := f.licmHoist(opt.HoistInvariantSemiJoinApply, left, right, on)
+	if newLeft == left && newOn == on {
+		return f.DynamicConstruct(opt.SemiJoinApplyOp, []memo.GroupID{newLeft, right, newOn}, private)
+	}
+	return f.ConstructSemiJoinApply(newLeft, right, newOn, private)
+}
+
+// ConstructLICMAntiJoinApply implements the HoistInvariantAntiJoinApply
+// rule: see licm.opt.
+func (f *Factory) ConstructLICMAntiJoinApply(
+	left, right, on, private memo.GroupID,
+) memo.GroupID {
+	newLeft, newOn := f.licmHoist(opt.HoistInvariantAntiJoinApply, left, right, on)
+	if newLeft == left && newOn == on {
+		return f.DynamicConstruct(opt.AntiJoinApplyOp, []memo.GroupID{newLeft, right, newOn}, private)
+	}
+	return f.ConstructAntiJoinApply(newLeft, right, newOn, private)
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package norm
+
+import "github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+
+// maxInlineRuleBindings is the number of named sub-patterns a rule site can
+// record without falling back to a heap-allocated map. Rules rarely bind
+// more than a handful of named sub-patterns ($input, $filter, $private,
+// ...), so this comfortably covers the overwhelming majority of rules while
+// keeping RuleBindings stack-allocated on the hot path.
+const maxInlineRuleBindings = 6
+
+// RuleBindings maps the names of a rule's named sub-patterns (as written in
+// its .opt match clause, e.g. "$input") to the memo groups the matcher bound
+// them to. It's passed to AppliedRuleFuncV2 so that a listener can
+// reconstruct exactly what a rule matched without re-deriving it from the
+// rewritten expression.
+//
+// The zero value is ready to use. RuleBindings stores its first
+// maxInlineRuleBindings entries inline, so constructing one costs no
+// allocation as long as that's enough room - which it is for virtually
+// every rule in practice.
+//
+// Only the hand-written CSE and LICM rule sites (cse.go, licm.go) populate a
+// RuleBindings; optgen-generated Normalize and Explore rule sites do not.
+type RuleBindings struct {
+	names  [maxInlineRuleBindings]string
+	groups [maxInlineRuleBindings]memo.GroupID
+	n      int
+
+	// overflow holds any bindings beyond maxInlineRuleBindings. It's nil
+	// (and never allocated) for the common case.
+	overflow map[string]memo.GroupID
+}
+
+// Add records that name was bound to group. A rule site calls Add once per
+// named sub-pattern it records, in the order they appear in the rule's match
+// clause.
+func (b *RuleBindings) Add(name string, group memo.GroupID) {
+	if b.n < len(b.names) {
+		b.names[b.n] = name
+		b.groups[b.n] = group
+		b.n++
+		return
+	}
+	if b.overflow == nil {
+		b.overflow = make(map[string]memo.GroupID)
+	}
+	b.overflow[name] = group
+}
+
+// Lookup returns the group bound to name, and whether it was found.
+func (b *RuleBindings) Lookup(name string) (memo.GroupID, bool) {
+	for i := 0; i < b.n; i++ {
+		if b.names[i] == name {
+			return b.groups[i], true
+		}
+	}
+	if b.overflow != nil {
+		group, ok := b.overflow[name]
+		return group, ok
+	}
+	return 0, false
+}
+
+// ForEach calls fn once for each binding. The first maxInlineRuleBindings
+// bindings are visited in the order Add was called; any in overflow are
+// visited after them, in no particular order.
+func (b *RuleBindings) ForEach(fn func(name string, group memo.GroupID)) {
+	for i := 0; i < b.n; i++ {
+		fn(b.names[i], b.groups[i])
+	}
+	for name, group := range b.overflow {
+		fn(name, group)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package norm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/norm/ruletracepb"
+	"github.com/cockroachdb/errors"
+)
+
+// StartRecording begins writing a RuleTrace to w: one length-prefixed
+// ruletracepb.RuleTraceEvent protobuf record per rule that is applied during
+// subsequent normalization, and one per rule application that ruleCycles
+// skips (see Factory.detectCycle). A rule that matches but is then vetoed by
+// a matched-rule callback, or that applies no change, is not recorded.
+// This augments (rather than replaces) any matched/applied rule callbacks
+// already registered, so recording can be layered on top of, e.g., the
+// EXPLAIN rule-tracking the optimizer already installs.
+//
+// A recording is the input to ReplayTrace, which is how a user narrows down
+// which rule in a long normalization run is responsible for a misbehaving
+// memo: feed the trace to the SQL reducer and binary search on
+// -stop-after-rule.
+func (f *Factory) StartRecording(w io.Writer) {
+	prevMatched := f.matchedRule
+	prevApplied := f.appliedRule
+	prevCycleSkipped := f.cycleSkipped
+
+	// pendingFingerprint and pendingGroup record the fingerprint and identity
+	// of the group a rule just matched against, captured from the group
+	// NotifyOnMatchedRule is now passed (rather than the whole memo's root,
+	// which is almost never what the rule actually rewrote). pendingGroup is
+	// written into each event's PreGroup field so that ReplayTrace can
+	// re-derive the same fingerprint from its own memo instead of comparing
+	// against its root.
+	var pendingFingerprint memo.Fingerprint
+	var pendingGroup memo.GroupID
+	f.NotifyOnMatchedRule(func(ruleName opt.RuleName, group memo.GroupID) bool {
+		pendingGroup = group
+		pendingFingerprint = f.mem.NormExpr(group).Fingerprint()
+		if prevMatched != nil {
+			return prevMatched(ruleName, group)
+		}
+		return true
+	})
+	f.cycleSkipped = func(ruleName opt.RuleName, fingerprint memo.Fingerprint) {
+		if prevCycleSkipped != nil {
+			prevCycleSkipped(ruleName, fingerprint)
+		}
+		writeRuleTraceEvent(w, &ruletracepb.RuleTraceEvent{
+			RuleName:       ruleName.String(),
+			PreGroup:       pendingGroup,
+			PreFingerprint: fingerprint[:],
+			CycleSkipped:   true,
+		})
+	}
+	f.NotifyOnAppliedRule(func(ruleName opt.RuleName, group memo.GroupID, expr memo.ExprOrdinal, added int) {
+		if prevApplied != nil {
+			prevApplied(ruleName, group, expr, added)
+		}
+		postFingerprint := f.mem.NormExpr(group).Fingerprint()
+		writeRuleTraceEvent(w, &ruletracepb.RuleTraceEvent{
+			RuleName:        ruleName.String(),
+			Group:           group,
+			ExprOrdinal:     expr,
+			PreGroup:        pendingGroup,
+			PreFingerprint:  pendingFingerprint[:],
+			PostFingerprint: postFingerprint[:],
+			Added:           int32(added),
+		})
+	})
+}
+
+// ReplayTrace checks the events recorded by StartRecording against f's memo.
+// It does not apply any rules itself: f must already have been built the
+// same way as the recorded run (typically by constructing the same
+// expression tree with the same Factory settings), so that its group IDs line
+// up with the recording. For each event, it verifies that the group the rule
+// matched against, and for an applied rule the group its replacement was
+// installed into, have the fingerprints that were recorded; a mismatch means
+// the two runs have diverged, which usually indicates a source of
+// nondeterminism in a custom match or replace function.
+func ReplayTrace(r io.Reader, f *Factory) error {
+	stepNum := 0
+	for {
+		ev, err := readRuleTraceEvent(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stepNum++
+
+		preFingerprint := f.mem.NormExpr(memo.GroupID(ev.PreGroup)).Fingerprint()
+		if string(preFingerprint[:]) != string(ev.PreFingerprint) {
+			return errors.Errorf(
+				"replay diverged at step %d (rule %s): pre-rewrite fingerprint mismatch", stepNum, ev.RuleName,
+			)
+		}
+		if ev.CycleSkipped {
+			continue
+		}
+		postFingerprint := f.mem.NormExpr(memo.GroupID(ev.Group)).Fingerprint()
+		if string(postFingerprint[:]) != string(ev.PostFingerprint) {
+			return errors.Errorf(
+				"replay diverged at step %d (rule %s): post-rewrite fingerprint mismatch", stepNum, ev.RuleName,
+			)
+		}
+	}
+}
+
+// writeRuleTraceEvent appends ev to w as a length-prefixed protobuf record.
+// Errors are not expected in practice (w is typically an in-memory buffer or
+// a file opened for the duration of a single reduction run), so rather than
+// threading an error back through the rule callbacks, a failure to marshal
+// ev or to write it to w panics.
+func writeRuleTraceEvent(w io.Writer, ev *ruletracepb.RuleTraceEvent) {
+	data, err := ev.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		panic(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		panic(err)
+	}
+}
+
+// readRuleTraceEvent reads one length-prefixed protobuf record written by
+// writeRuleTraceEvent, returning io.EOF once the reader is exhausted between
+// records.
+func readRuleTraceEvent(r io.Reader) (*ruletracepb.RuleTraceEvent, error) {
+	length, err := binary.ReadUvarint(&byteReader{r: r})
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	ev := &ruletracepb.RuleTraceEvent{}
+	if err := ev.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("corrupt rule trace record: %v", err)
+	}
+	return ev, nil
+}
+
+// byteReader adapts an io.Reader to io.ByteReader, which binary.ReadUvarint
+// requires, without forcing every caller of ReplayTrace to pass a
+// *bufio.Reader.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
@@ -0,0 +1,178 @@
+// This file mirrors the message in ruletrace.proto; its encoding code is
+// written by hand rather than generated by protoc-gen-gogo.
+
+package ruletracepb
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+	"github.com/cockroachdb/errors"
+)
+
+// RuleTraceEvent records a single step taken by norm.Factory while
+// normalizing a memo: either a rule being applied, or a rule being skipped
+// because ruleCycles detected that it would recurse on an expression it had
+// already started rewriting. A sequence of these events, in order, is
+// sufficient to replay a normalization run and verify that it's
+// deterministic.
+//
+// This type mirrors the message defined in ruletrace.proto. Marshal and
+// Unmarshal implement the standard length-delimited, tag-prefixed protobuf
+// wire encoding for its fields by hand, since this package has no generated
+// counterpart checked in elsewhere in the tree.
+type RuleTraceEvent struct {
+	RuleName        string
+	Group           memo.GroupID
+	ExprOrdinal     memo.ExprOrdinal
+	PreFingerprint  []byte
+	PostFingerprint []byte
+	Added           int32
+	CycleSkipped    bool
+	PreGroup        memo.GroupID
+}
+
+const (
+	ruleTraceEventRuleNameField        = 1
+	ruleTraceEventGroupField           = 2
+	ruleTraceEventExprOrdinalField     = 3
+	ruleTraceEventPreFingerprintField  = 4
+	ruleTraceEventPostFingerprintField = 5
+	ruleTraceEventAddedField           = 6
+	ruleTraceEventCycleSkippedField    = 7
+	ruleTraceEventPreGroupField        = 8
+)
+
+const (
+	wireTypeVarint = 0
+	wireTypeBytes  = 2
+)
+
+// Marshal serializes ev using the standard protobuf wire encoding.
+func (ev *RuleTraceEvent) Marshal() ([]byte, error) {
+	var buf []byte
+	buf = appendStringField(buf, ruleTraceEventRuleNameField, ev.RuleName)
+	buf = appendVarintField(buf, ruleTraceEventGroupField, uint64(ev.Group))
+	buf = appendVarintField(buf, ruleTraceEventExprOrdinalField, uint64(ev.ExprOrdinal))
+	buf = appendBytesField(buf, ruleTraceEventPreFingerprintField, ev.PreFingerprint)
+	buf = appendBytesField(buf, ruleTraceEventPostFingerprintField, ev.PostFingerprint)
+	buf = appendVarintField(buf, ruleTraceEventAddedField, uint64(uint32(ev.Added)))
+	if ev.CycleSkipped {
+		buf = appendVarintField(buf, ruleTraceEventCycleSkippedField, 1)
+	}
+	buf = appendVarintField(buf, ruleTraceEventPreGroupField, uint64(ev.PreGroup))
+	return buf, nil
+}
+
+// Unmarshal deserializes data, previously produced by Marshal, into ev.
+func (ev *RuleTraceEvent) Unmarshal(data []byte) error {
+	*ev = RuleTraceEvent{}
+	for len(data) > 0 {
+		tag, wireType, n, err := readTag(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		switch wireType {
+		case wireTypeVarint:
+			v, n, err := readVarint(data)
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+			switch tag {
+			case ruleTraceEventGroupField:
+				ev.Group = memo.GroupID(v)
+			case ruleTraceEventExprOrdinalField:
+				ev.ExprOrdinal = memo.ExprOrdinal(v)
+			case ruleTraceEventAddedField:
+				ev.Added = int32(v)
+			case ruleTraceEventCycleSkippedField:
+				ev.CycleSkipped = v != 0
+			case ruleTraceEventPreGroupField:
+				ev.PreGroup = memo.GroupID(v)
+			default:
+				return errors.Errorf("ruletracepb: unknown varint field %d", tag)
+			}
+		case wireTypeBytes:
+			b, n, err := readBytes(data)
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+			switch tag {
+			case ruleTraceEventRuleNameField:
+				ev.RuleName = string(b)
+			case ruleTraceEventPreFingerprintField:
+				ev.PreFingerprint = b
+			case ruleTraceEventPostFingerprintField:
+				ev.PostFingerprint = b
+			default:
+				return errors.Errorf("ruletracepb: unknown bytes field %d", tag)
+			}
+		default:
+			return errors.Errorf("ruletracepb: unsupported wire type %d", wireType)
+		}
+	}
+	return nil
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendTag(buf, field, wireTypeVarint)
+	return appendVarint(buf, v)
+}
+
+func appendStringField(buf []byte, field int, s string) []byte {
+	return appendBytesField(buf, field, []byte(s))
+}
+
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	if b == nil {
+		// Leave a nil field out entirely, so that Unmarshal leaves it nil.
+		return buf
+	}
+	buf = appendTag(buf, field, wireTypeBytes)
+	buf = appendVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendTag(buf []byte, field, wireType int) []byte {
+	return appendVarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func readTag(data []byte) (field, wireType int, n int, err error) {
+	v, n, err := readVarint(data)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(v >> 3), int(v & 0x7), n, nil
+}
+
+func readVarint(data []byte) (uint64, int, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return v, n, nil
+}
+
+func readBytes(data []byte) ([]byte, int, error) {
+	length, n, err := readVarint(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	data = data[n:]
+	if uint64(len(data)) < length {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	out := make([]byte, length)
+	copy(out, data[:length])
+	return out, n + int(length), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package ruletracepb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/memo"
+)
+
+// TestRuleTraceEventRoundTrip verifies that every field of a RuleTraceEvent,
+// including PreGroup, survives a Marshal/Unmarshal round trip. PreGroup is
+// what ReplayTrace uses to locate the group a rule matched against; if it
+// were silently dropped (as it originally was, before this field existed),
+// ReplayTrace would have no way to tell which group to re-derive the
+// pre-rewrite fingerprint from, and would fall back to comparing against the
+// wrong group for every rule that didn't happen to match at the memo root.
+func TestRuleTraceEventRoundTrip(t *testing.T) {
+	orig := &RuleTraceEvent{
+		RuleName:        "SomeRule",
+		Group:           memo.GroupID(7),
+		ExprOrdinal:     memo.ExprOrdinal(2),
+		PreFingerprint:  []byte{1, 2, 3},
+		PostFingerprint: []byte{4, 5, 6},
+		Added:           3,
+		CycleSkipped:    false,
+		PreGroup:        memo.GroupID(5),
+	}
+
+	data, err := orig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got RuleTraceEvent
+	if err := got.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orig, &got) {
+		t.Errorf("round trip mismatch:\n  original: %+v\n  got:      %+v", orig, &got)
+	}
+}
+
+// TestRuleTraceEventCycleSkipped verifies that a cycle-skip event - which
+// carries no Group, ExprOrdinal, or PostFingerprint, only a PreGroup and
+// PreFingerprint - round trips correctly.
+func TestRuleTraceEventCycleSkipped(t *testing.T) {
+	orig := &RuleTraceEvent{
+		RuleName:       "HoistInvariantInnerJoinApply",
+		PreFingerprint: []byte{9, 9, 9},
+		CycleSkipped:   true,
+		PreGroup:       memo.GroupID(11),
+	}
+
+	data, err := orig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got RuleTraceEvent
+	if err := got.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orig, &got) {
+		t.Errorf("round trip mismatch:\n  original: %+v\n  got:      %+v", orig, &got)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// Package reduce implements a generic delta-debugging-style file reducer.
+// Given a starting file and a set of passes that each propose candidate
+// simplifications, it repeatedly applies the first candidate that is still
+// "interesting" until no pass can make further progress.
+package reduce
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// File is the contents of the file being reduced.
+type File []byte
+
+// Pass produces the ith candidate simplification of f. It returns ok=false
+// once i is out of range, meaning the pass is exhausted for f. Implementations
+// should be deterministic for a given (r, f, i) so that a fixed seed and a
+// fixed OptionParallel setting produce a reproducible sequence of candidates
+// across runs.
+type Pass func(r *rand.Rand, f File, i int) (out File, ok bool)
+
+// InterestingFn reports whether f reproduces the condition being reduced for
+// (e.g., a particular panic or error). Implementations that shell out to a
+// subprocess should watch ctx and kill the subprocess promptly if it is
+// cancelled, since a concurrent candidate may have already won the race.
+type InterestingFn func(ctx context.Context, f File) bool
+
+// config holds the options accumulated from a Reduce call.
+type config struct {
+	parallel int
+	rng      *rand.Rand
+}
+
+// Option configures a Reduce invocation.
+type Option func(*config)
+
+// OptionParallel causes each pass to evaluate up to n candidates concurrently
+// instead of one at a time. The candidate with the lowest index that is
+// interesting always wins the race, regardless of which goroutine finishes
+// first, so reductions with a given OptionSeed and a given n are
+// reproducible. Every candidate generated for a batch draws from the shared
+// random source, so runs with different values of n can see different
+// candidates. n <= 1 disables parallelism.
+func OptionParallel(n int) Option {
+	return func(c *config) { c.parallel = n }
+}
+
+// OptionSeed fixes the random seed used by passes, so that repeated runs
+// (parallel or not) produce the same sequence of reductions.
+func OptionSeed(seed int64) Option {
+	return func(c *config) { c.rng = rand.New(rand.NewSource(seed)) }
+}
+
+// Reduce simplifies f by repeatedly trying passes in order, applying the
+// first candidate each pass produces that is still interesting and then
+// going on to the next pass with the reduced file. After the last pass it
+// starts another round from the first pass, and it returns the most-reduced
+// File once a whole round makes no further progress.
+func Reduce(
+	logger io.Writer, f File, interesting InterestingFn, opts []Option, passes ...Pass,
+) (File, error) {
+	cfg := config{parallel: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.rng == nil {
+		cfg.rng = rand.New(rand.NewSource(0))
+	}
+
+	for {
+		progress := false
+		for _, pass := range passes {
+			out, ok := tryPass(&cfg, pass, f, interesting)
+			if !ok {
+				continue
+			}
+			if logger != nil {
+				fmt.Fprintf(logger, "reduced %d bytes -> %d bytes\n", len(f), len(out))
+			}
+			f = out
+			progress = true
+		}
+		if !progress {
+			return f, nil
+		}
+	}
+}
+
+// tryPass finds the lowest-index candidate produced by pass that is
+// interesting, evaluating up to cfg.parallel candidates concurrently.
+func tryPass(cfg *config, pass Pass, f File, interesting InterestingFn) (File, bool) {
+	batch := cfg.parallel
+	if batch < 1 {
+		batch = 1
+	}
+	for base := 0; ; base += batch {
+		type result struct {
+			out File
+			ok  bool
+		}
+		results := make([]result, batch)
+		ctxs := make([]context.Context, batch)
+		cancels := make([]context.CancelFunc, batch)
+		done := make(chan int, batch)
+
+		n := 0
+		for j := 0; j < batch; j++ {
+			out, ok := pass(cfg.rng, f, base+j)
+			if !ok {
+				break
+			}
+			n = j + 1
+			ctxs[j], cancels[j] = context.WithCancel(context.Background())
+			results[j] = result{out: out}
+			go func(j int, out File) {
+				hit := interesting(ctxs[j], out)
+				results[j].ok = hit
+				done <- j
+			}(j, out)
+		}
+		if n == 0 {
+			return nil, false
+		}
+
+		// Wait until the winner (lowest index that is interesting) is
+		// determined, or until every candidate has reported in. As soon as
+		// we know a prefix of indices are all resolved, we can cancel any
+		// later candidate that is no longer eligible to win.
+		reported := make([]bool, n)
+		resolved := 0
+		for resolved < n {
+			j := <-done
+			reported[j] = true
+			resolved++
+
+			// Find the winner: the lowest reported index that is
+			// interesting, provided every lower index is also resolved and
+			// not interesting.
+			winner := -1
+			for k := 0; k < n; k++ {
+				if !reported[k] {
+					break
+				}
+				if results[k].ok {
+					winner = k
+					break
+				}
+			}
+			if winner >= 0 {
+				for k := winner + 1; k < n; k++ {
+					cancels[k]()
+				}
+				return results[winner].out, true
+			}
+		}
+		for j := 0; j < n; j++ {
+			cancels[j]()
+		}
+		if n < batch {
+			// Pass is exhausted and none of the remaining candidates hit.
+			return nil, false
+		}
+	}
+}